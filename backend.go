@@ -0,0 +1,136 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// backend is implemented by each supported metrics sink. submit receives the
+// same immutable Snapshot on every flush interval, so registering more than
+// one backend does not cause them to compete over the live aggregation maps.
+type backend interface {
+	submit(snap *Snapshot, deadline time.Time) error
+}
+
+// Snapshot is a point-in-time, read-only copy of the aggregated metrics taken
+// by takeSnapshot at the start of a flush interval. Every registered backend
+// receives the same Snapshot, so none of them mutate the live counters,
+// gauges, timers or sets maps directly.
+type Snapshot struct {
+	Now int64
+
+	Counters map[string]float64
+	Gauges   map[string]float64
+	Timers   map[string]Timer
+	Sets     map[string][]string
+
+	// ZeroFilledCounters holds buckets that have gone quiet but should still
+	// report a zero value for up to *persistCountKeys more intervals.
+	ZeroFilledCounters []string
+
+	// TimerStats holds each timer bucket's aggregates (min/max/mean/count/
+	// percentiles), computed once here rather than once per backend - with
+	// more than one backend registered, redoing computeTimerStats per
+	// backend would redo the same sort-or-digest work per bucket once per
+	// backend instead of once per flush.
+	TimerStats map[string]timerStats
+}
+
+// takeSnapshot atomically drains the live counters, timers and sets maps and
+// copies the gauges map into a Snapshot, leaving the package-level maps ready
+// to accumulate the next interval's packets. It is the single place that
+// mutates countInactivity, so registering multiple backends no longer causes
+// duplicate purge bookkeeping.
+func takeSnapshot(now int64) *Snapshot {
+	snap := &Snapshot{
+		Now:      now,
+		Counters: counters,
+		Timers:   timers,
+		Sets:     sets,
+	}
+
+	snap.TimerStats = make(map[string]timerStats, len(snap.Timers))
+	for bucket, timer := range snap.Timers {
+		snap.TimerStats[bucket] = computeTimerStats(timer, percentThreshold)
+	}
+
+	counters = make(map[string]float64)
+	timers = make(map[string]Timer)
+	sets = make(map[string][]string)
+
+	gaugesCopy := make(map[string]float64, len(gauges))
+	for bucket, value := range gauges {
+		gaugesCopy[bucket] = value
+	}
+	snap.Gauges = gaugesCopy
+	if *deleteGauges {
+		gauges = make(map[string]float64)
+	}
+
+	for bucket := range snap.Counters {
+		countInactivity[bucket] = 0
+	}
+	for bucket, purgeCount := range countInactivity {
+		if purgeCount > 0 {
+			snap.ZeroFilledCounters = append(snap.ZeroFilledCounters, bucket)
+		}
+		countInactivity[bucket]++
+		if countInactivity[bucket] > *persistCountKeys {
+			delete(countInactivity, bucket)
+		}
+	}
+
+	if droppedHighCardinalitySeries > 0 {
+		snap.Counters["statsd.dropped_high_cardinality_series"] = float64(droppedHighCardinalitySeries)
+		droppedHighCardinalitySeries = 0
+	}
+
+	return snap
+}
+
+// backendRegistry fans a single Snapshot out to every backend registered
+// against it, enabling `-backend=graphite,openfalcon,influxdb`-style
+// multi-sink configurations without double-consuming the aggregated data.
+type backendRegistry struct {
+	backends []backend
+}
+
+func newBackendRegistry(backends ...backend) *backendRegistry {
+	return &backendRegistry{backends: backends}
+}
+
+func (r *backendRegistry) register(bd backend) {
+	r.backends = append(r.backends, bd)
+}
+
+// flush takes one snapshot of the current aggregation state and submits it
+// to every registered backend concurrently, each against the same deadline.
+// Backends run in parallel rather than in sequence so that one unhealthy
+// backend's own retry loop - which can burn the whole deadline on its own -
+// can't consume attempts that would otherwise go to the other, healthy
+// backends registered in the same flush. It returns the first error
+// encountered but still gives every backend a chance to run.
+func (r *backendRegistry) flush(now int64, deadline time.Time) error {
+	snap := takeSnapshot(now)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+	for _, bd := range r.backends {
+		wg.Add(1)
+		go func(bd backend) {
+			defer wg.Done()
+			if err := bd.submit(snap, deadline); err != nil {
+				log.Printf("ERROR: backend submit failed - %s", err)
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+			}
+		}(bd)
+	}
+	wg.Wait()
+	return firstErr
+}
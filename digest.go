@@ -0,0 +1,220 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// tdigestCentroid is a single weighted mean tracked by a TDigest.
+type tdigestCentroid struct {
+	mean  float64
+	count float64
+}
+
+// TDigest is a compressible sketch of a distribution: instead of retaining
+// every sample it maintains a small, bounded number of weighted centroids,
+// merging nearby ones as more samples arrive. compression controls the
+// accuracy/size tradeoff - higher values keep more centroids (more accurate
+// tails, more memory); the classic default is 100.
+type TDigest struct {
+	compression float64
+	centroids   []tdigestCentroid
+	count       float64
+	min, max    float64
+}
+
+// NewTDigest returns an empty digest with the given compression factor.
+func NewTDigest(compression float64) *TDigest {
+	return &TDigest{compression: compression}
+}
+
+// Add records a single sample.
+func (td *TDigest) Add(value float64) {
+	if td.count == 0 {
+		td.min, td.max = value, value
+	} else {
+		if value < td.min {
+			td.min = value
+		}
+		if value > td.max {
+			td.max = value
+		}
+	}
+
+	td.centroids = append(td.centroids, tdigestCentroid{mean: value, count: 1})
+	td.count++
+
+	// Bound memory by compressing once the uncompressed centroid count grows
+	// well past the target size, rather than on every single Add.
+	if float64(len(td.centroids)) > td.compression*20 {
+		td.compress()
+	}
+}
+
+// compress sorts and merges adjacent centroids, bounding how much weight any
+// single centroid may carry based on its position in the distribution - this
+// keeps the tails (where percentiles matter most) precise while allowing the
+// dense middle to merge aggressively.
+func (td *TDigest) compress() {
+	if len(td.centroids) < 2 {
+		return
+	}
+	sort.Slice(td.centroids, func(i, j int) bool { return td.centroids[i].mean < td.centroids[j].mean })
+
+	merged := td.centroids[:1]
+	cumulative := merged[0].count
+	for _, c := range td.centroids[1:] {
+		last := &merged[len(merged)-1]
+		q := (cumulative - last.count/2) / td.count
+		maxCount := 4 * td.count * q * (1 - q) / td.compression
+		if last.count+c.count <= maxCount {
+			last.mean = (last.mean*last.count + c.mean*c.count) / (last.count + c.count)
+			last.count += c.count
+		} else {
+			merged = append(merged, c)
+		}
+		cumulative += c.count
+	}
+	td.centroids = merged
+}
+
+// Quantile returns an estimate of the value at quantile q (0..1), linearly
+// interpolating between the two nearest centroids.
+func (td *TDigest) Quantile(q float64) float64 {
+	if len(td.centroids) == 0 {
+		return 0
+	}
+	td.compress()
+	if len(td.centroids) == 1 {
+		return td.centroids[0].mean
+	}
+
+	target := q * td.count
+	var cumulative float64
+	for i, c := range td.centroids {
+		if cumulative+c.count >= target {
+			if i == 0 {
+				return c.mean
+			}
+			prev := td.centroids[i-1]
+			frac := (target - cumulative) / c.count
+			return prev.mean + frac*(c.mean-prev.mean)
+		}
+		cumulative += c.count
+	}
+	return td.centroids[len(td.centroids)-1].mean
+}
+
+// Count returns the number of samples added.
+func (td *TDigest) Count() int64 { return int64(td.count) }
+
+// Min returns the smallest sample added.
+func (td *TDigest) Min() float64 { return td.min }
+
+// Max returns the largest sample added.
+func (td *TDigest) Max() float64 { return td.max }
+
+// Mean returns the weighted mean of all samples added.
+func (td *TDigest) Mean() float64 {
+	if td.count == 0 {
+		return 0
+	}
+	var sum float64
+	for _, c := range td.centroids {
+		sum += c.mean * c.count
+	}
+	return sum / td.count
+}
+
+// timerStats is the set of aggregates processTimers needs out of a timer
+// bucket, regardless of whether they came from an exact sort or a sketch.
+type timerStats struct {
+	Count       int
+	Min         float64
+	Max         float64
+	Mean        float64
+	Percentiles []float64 // aligned index-for-index with the Percentiles passed in
+}
+
+// computeTimerStats aggregates a timer bucket either by sorting the full
+// sample slice (the historical, exact behavior) or by feeding it through a
+// TDigest sketch, depending on *timerSketchEnabled. This only changes how a
+// bucket's samples are aggregated at flush time: it replaces an O(n log n)
+// sort with an O(n log k) digest build against k centroids, trading a small
+// amount of percentile accuracy for cheaper queries. It does NOT change what
+// `timers` holds between flushes - every raw sample is still retained in
+// memory until the next flush regardless of this flag, since that
+// retention happens on the ingest side, which this sketch mode does not
+// touch. Bounding per-metric memory requires the ingest path to append
+// directly into a live TDigest instead of a []float64.
+func computeTimerStats(timer Timer, pctls Percentiles) timerStats {
+	if timerSketchEnabled != nil && *timerSketchEnabled {
+		return timerStatsFromSketch(timer, pctls)
+	}
+	return timerStatsExact(timer, pctls)
+}
+
+func timerStatsFromSketch(timer Timer, pctls Percentiles) timerStats {
+	compression := 100.0
+	if timerSketchCompression != nil && *timerSketchCompression > 0 {
+		compression = *timerSketchCompression
+	}
+
+	digest := NewTDigest(compression)
+	for _, value := range timer {
+		digest.Add(value)
+	}
+
+	stats := timerStats{
+		Count: len(timer),
+		Min:   digest.Min(),
+		Max:   digest.Max(),
+		Mean:  digest.Mean(),
+	}
+	for _, pct := range pctls {
+		abs := pct.float
+		if abs < 0 {
+			abs = 100 + abs
+		}
+		stats.Percentiles = append(stats.Percentiles, digest.Quantile(abs/100.0))
+	}
+	return stats
+}
+
+// timerStatsExact reproduces the original sort.Sort-based aggregation byte
+// for byte, so sketch mode can be disabled without changing any emitted
+// values.
+func timerStatsExact(timer Timer, pctls Percentiles) timerStats {
+	sort.Sort(timer)
+	min := timer[0]
+	max := timer[len(timer)-1]
+	count := len(timer)
+
+	sum := float64(0)
+	for _, value := range timer {
+		sum += value
+	}
+	mean := sum / float64(count)
+
+	stats := timerStats{Count: count, Min: min, Max: max, Mean: mean}
+	for _, pct := range pctls {
+		maxAtThreshold := max
+		if len(timer) > 1 {
+			var abs float64
+			if pct.float >= 0 {
+				abs = pct.float
+			} else {
+				abs = 100 + pct.float
+			}
+			// poor man's math.Round(x):
+			// math.Floor(x + 0.5)
+			indexOfPerc := int(math.Floor(((abs / 100.0) * float64(count)) + 0.5))
+			if pct.float >= 0 {
+				indexOfPerc-- // index offset=0
+			}
+			maxAtThreshold = timer[indexOfPerc]
+		}
+		stats.Percentiles = append(stats.Percentiles, maxAtThreshold)
+	}
+	return stats
+}
@@ -5,58 +5,52 @@ import (
 	"errors"
 	"fmt"
 	"log"
-	"math"
 	"net"
-	"sort"
 	"strconv"
 	"time"
 )
 
 type graphiteBackend struct {
-	addr string
+	addr        string
+	retryPolicy retryPolicy
+
+	// spool holds buffers that still failed after retries exhausted, so the
+	// next successful flush can carry them along instead of losing them.
+	spool    [][]byte
+	maxSpool int
 }
 
 func NewGraphiteBackend(addr string) backend {
 	return &graphiteBackend{
-		addr: addr,
+		addr:        addr,
+		retryPolicy: defaultRetryPolicy,
+		maxSpool:    100,
 	}
 }
 
-func (bd *graphiteBackend) submit(deadline time.Time) error {
+func (bd *graphiteBackend) submit(snap *Snapshot, deadline time.Time) error {
 	var buffer bytes.Buffer
 	var num int64
 
-	now := time.Now().Unix()
-
-	client, err := net.Dial("tcp", bd.addr)
-	if err != nil {
-		if *debug {
-			log.Printf("WARNING: resetting counters when in debug mode")
-			processCounters(&buffer, now)
-			processGauges(&buffer, now)
-			processTimers(&buffer, now, percentThreshold)
-			processSets(&buffer, now)
-		}
-		errmsg := fmt.Sprintf("dialing %s failed - %s", *graphiteAddress, err)
-		return errors.New(errmsg)
+	num += processCounters(&buffer, snap)
+	num += processGauges(&buffer, snap)
+	num += processTimers(&buffer, snap, percentThreshold)
+	num += processSets(&buffer, snap)
+	if num > 0 {
+		bd.spool = append(bd.spool, buffer.Bytes())
 	}
-	defer client.Close()
-
-	err = client.SetDeadline(deadline)
-	if err != nil {
-		return err
+	if len(bd.spool) > bd.maxSpool {
+		dropped := len(bd.spool) - bd.maxSpool
+		log.Printf("WARNING: graphite spool full, dropping %d oldest batch(es)", dropped)
+		bd.spool = bd.spool[dropped:]
 	}
-
-	num += processCounters(&buffer, now)
-	num += processGauges(&buffer, now)
-	num += processTimers(&buffer, now, percentThreshold)
-	num += processSets(&buffer, now)
-	if num == 0 {
+	if len(bd.spool) == 0 {
 		return nil
 	}
 
+	payload := bytes.Join(bd.spool, nil)
 	if *debug {
-		for _, line := range bytes.Split(buffer.Bytes(), []byte("\n")) {
+		for _, line := range bytes.Split(payload, []byte("\n")) {
 			if len(line) == 0 {
 				continue
 			}
@@ -64,125 +58,118 @@ func (bd *graphiteBackend) submit(deadline time.Time) error {
 		}
 	}
 
-	_, err = client.Write(buffer.Bytes())
+	err := withRetry(deadline, bd.retryPolicy, func() error {
+		return bd.write(payload, deadline)
+	})
 	if err != nil {
-		errmsg := fmt.Sprintf("failed to write stats - %s", err)
+		errmsg := fmt.Sprintf("failed to write stats to %s - %s", bd.addr, err)
 		return errors.New(errmsg)
 	}
 
 	log.Printf("sent %d stats to %s", num, *graphiteAddress)
+	bd.spool = nil
 
 	return nil
 }
 
-func processCounters(buffer *bytes.Buffer, now int64) int64 {
+func (bd *graphiteBackend) write(payload []byte, deadline time.Time) error {
+	if err := maybeInjectFailure(); err != nil {
+		return err
+	}
+
+	client, err := net.Dial("tcp", bd.addr)
+	if err != nil {
+		return fmt.Errorf("dialing %s failed - %s", bd.addr, err)
+	}
+	defer client.Close()
+
+	if err := client.SetDeadline(deadline); err != nil {
+		return err
+	}
+
+	if _, err := client.Write(payload); err != nil {
+		return fmt.Errorf("failed to write stats - %s", err)
+	}
+
+	return nil
+}
+
+// graphiteName renders a bucket key's bare metric name plus, if it carries
+// any, its tags in Graphite 1.1+ tag syntax (";tag1=val1;tag2=val2").
+func graphiteName(bucket string) string {
+	name, tags := splitCanonicalKey(bucket)
+	return name + graphiteTagSuffix(tags)
+}
+
+func processCounters(buffer *bytes.Buffer, snap *Snapshot) int64 {
 	var num int64
-	// continue sending zeros for counters for a short period of time even if we have no new data
-	for bucket, value := range counters {
-		fmt.Fprintf(buffer, "%s %s %d\n", bucket, strconv.FormatFloat(value, 'f', -1, 64), now)
-		delete(counters, bucket)
-		countInactivity[bucket] = 0
+	for bucket, value := range snap.Counters {
+		fmt.Fprintf(buffer, "%s %s %d\n", graphiteName(bucket), strconv.FormatFloat(value, 'f', -1, 64), snap.Now)
 		num++
 	}
-	for bucket, purgeCount := range countInactivity {
-		if purgeCount > 0 {
-			fmt.Fprintf(buffer, "%s 0 %d\n", bucket, now)
-			num++
-		}
-		countInactivity[bucket] += 1
-		if countInactivity[bucket] > *persistCountKeys {
-			delete(countInactivity, bucket)
-		}
+	// continue sending zeros for counters for a short period of time even if we have no new data
+	for _, bucket := range snap.ZeroFilledCounters {
+		fmt.Fprintf(buffer, "%s 0 %d\n", graphiteName(bucket), snap.Now)
+		num++
 	}
 	return num
 }
 
-func processGauges(buffer *bytes.Buffer, now int64) int64 {
+func processGauges(buffer *bytes.Buffer, snap *Snapshot) int64 {
 	var num int64
 
-	for bucket, currentValue := range gauges {
-		fmt.Fprintf(buffer, "%s %s %d\n", bucket, strconv.FormatFloat(currentValue, 'f', -1, 64), now)
+	for bucket, currentValue := range snap.Gauges {
+		fmt.Fprintf(buffer, "%s %s %d\n", graphiteName(bucket), strconv.FormatFloat(currentValue, 'f', -1, 64), snap.Now)
 		num++
-		if *deleteGauges {
-			delete(gauges, bucket)
-		}
 	}
 	return num
 }
 
-func processSets(buffer *bytes.Buffer, now int64) int64 {
-	num := int64(len(sets))
-	for bucket, set := range sets {
+func processSets(buffer *bytes.Buffer, snap *Snapshot) int64 {
+	num := int64(len(snap.Sets))
+	for bucket, set := range snap.Sets {
 
 		uniqueSet := map[string]bool{}
 		for _, str := range set {
 			uniqueSet[str] = true
 		}
 
-		fmt.Fprintf(buffer, "%s %d %d\n", bucket, len(uniqueSet), now)
-		delete(sets, bucket)
+		fmt.Fprintf(buffer, "%s %d %d\n", graphiteName(bucket), len(uniqueSet), snap.Now)
 	}
 	return num
 }
 
-func processTimers(buffer *bytes.Buffer, now int64, pctls Percentiles) int64 {
+func processTimers(buffer *bytes.Buffer, snap *Snapshot, pctls Percentiles) int64 {
 	var num int64
-	for bucket, timer := range timers {
-		bucketWithoutPostfix := bucket[:len(bucket)-len(*postfix)]
+	for bucket := range snap.Timers {
+		bucketWithoutPostfix, tags := splitTimerBucket(bucket)
+		tagSuffix := graphiteTagSuffix(tags)
 		num++
 
-		sort.Sort(timer)
-		min := timer[0]
-		max := timer[len(timer)-1]
-		maxAtThreshold := max
-		count := len(timer)
-
-		sum := float64(0)
-		for _, value := range timer {
-			sum += value
-		}
-		mean := sum / float64(len(timer))
-
-		for _, pct := range pctls {
-			if len(timer) > 1 {
-				var abs float64
-				if pct.float >= 0 {
-					abs = pct.float
-				} else {
-					abs = 100 + pct.float
-				}
-				// poor man's math.Round(x):
-				// math.Floor(x + 0.5)
-				indexOfPerc := int(math.Floor(((abs / 100.0) * float64(count)) + 0.5))
-				if pct.float >= 0 {
-					indexOfPerc -= 1 // index offset=0
-				}
-				maxAtThreshold = timer[indexOfPerc]
-			}
+		stats := snap.TimerStats[bucket]
 
+		for i, pct := range pctls {
 			var tmpl string
 			var pctstr string
 			if pct.float >= 0 {
-				tmpl = "%s.upper_%s%s %s %d\n"
+				tmpl = "%s.upper_%s%s%s %s %d\n"
 				pctstr = pct.str
 			} else {
-				tmpl = "%s.lower_%s%s %s %d\n"
+				tmpl = "%s.lower_%s%s%s %s %d\n"
 				pctstr = pct.str[1:]
 			}
-			threshold_s := strconv.FormatFloat(maxAtThreshold, 'f', -1, 64)
-			fmt.Fprintf(buffer, tmpl, bucketWithoutPostfix, pctstr, *postfix, threshold_s, now)
+			threshold_s := strconv.FormatFloat(stats.Percentiles[i], 'f', -1, 64)
+			fmt.Fprintf(buffer, tmpl, bucketWithoutPostfix, pctstr, *postfix, tagSuffix, threshold_s, snap.Now)
 		}
 
-		mean_s := strconv.FormatFloat(mean, 'f', -1, 64)
-		max_s := strconv.FormatFloat(max, 'f', -1, 64)
-		min_s := strconv.FormatFloat(min, 'f', -1, 64)
-
-		fmt.Fprintf(buffer, "%s.mean%s %s %d\n", bucketWithoutPostfix, *postfix, mean_s, now)
-		fmt.Fprintf(buffer, "%s.upper%s %s %d\n", bucketWithoutPostfix, *postfix, max_s, now)
-		fmt.Fprintf(buffer, "%s.lower%s %s %d\n", bucketWithoutPostfix, *postfix, min_s, now)
-		fmt.Fprintf(buffer, "%s.count%s %d %d\n", bucketWithoutPostfix, *postfix, count, now)
+		mean_s := strconv.FormatFloat(stats.Mean, 'f', -1, 64)
+		max_s := strconv.FormatFloat(stats.Max, 'f', -1, 64)
+		min_s := strconv.FormatFloat(stats.Min, 'f', -1, 64)
 
-		delete(timers, bucket)
+		fmt.Fprintf(buffer, "%s.mean%s%s %s %d\n", bucketWithoutPostfix, *postfix, tagSuffix, mean_s, snap.Now)
+		fmt.Fprintf(buffer, "%s.upper%s%s %s %d\n", bucketWithoutPostfix, *postfix, tagSuffix, max_s, snap.Now)
+		fmt.Fprintf(buffer, "%s.lower%s%s %s %d\n", bucketWithoutPostfix, *postfix, tagSuffix, min_s, snap.Now)
+		fmt.Fprintf(buffer, "%s.count%s%s %d %d\n", bucketWithoutPostfix, *postfix, tagSuffix, stats.Count, snap.Now)
 	}
 	return num
 }
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// influxDBVersion selects the write API dialect to speak.
+type influxDBVersion int
+
+const (
+	influxDBV1 influxDBVersion = iota
+	influxDBV2
+)
+
+type influxDBBackend struct {
+	addr      string
+	version   influxDBVersion
+	database  string // v1 database, or v2 bucket
+	org       string // v2 only
+	token     string // v2 auth token
+	precision string // s, ms or ns
+	gzip      bool
+
+	client      *http.Client
+	writeURL    string
+	retryPolicy retryPolicy
+
+	queue    [][]byte
+	maxQueue int
+}
+
+// NewInfluxDBBackend returns a backend that writes counters/gauges/timers/sets
+// as InfluxDB line protocol to addr's HTTP write endpoint. version selects
+// between the v1 `/write` (db-based) and v2 `/api/v2/write` (org/bucket +
+// token) dialects. maxQueue bounds how many failed flush cycles are retained
+// in memory for the next, combined, write attempt.
+func NewInfluxDBBackend(addr, database, org, token string, version influxDBVersion, precision string, gzipEnabled bool, maxQueue int) backend {
+	bd := &influxDBBackend{
+		addr:        addr,
+		version:     version,
+		database:    database,
+		org:         org,
+		token:       token,
+		precision:   precision,
+		gzip:        gzipEnabled,
+		client:      &http.Client{},
+		retryPolicy: defaultRetryPolicy,
+		maxQueue:    maxQueue,
+	}
+	bd.writeURL = bd.buildWriteURL()
+	return bd
+}
+
+func (bd *influxDBBackend) buildWriteURL() string {
+	if bd.version == influxDBV2 {
+		return fmt.Sprintf("http://%s/api/v2/write?org=%s&bucket=%s&precision=%s",
+			bd.addr, bd.org, bd.database, bd.precision)
+	}
+	return fmt.Sprintf("http://%s/write?db=%s&precision=%s", bd.addr, bd.database, bd.precision)
+}
+
+func (bd *influxDBBackend) submit(snap *Snapshot, deadline time.Time) error {
+	var buffer bytes.Buffer
+	var num int64
+
+	now := scaleToPrecision(snap.Now, bd.precision)
+
+	num += bd.processCounters(&buffer, snap, now)
+	num += bd.processGauges(&buffer, snap, now)
+	num += bd.processTimers(&buffer, snap, now, percentThreshold)
+	num += bd.processSets(&buffer, snap, now)
+
+	if num > 0 {
+		bd.enqueue(buffer.Bytes())
+	}
+	if len(bd.queue) == 0 {
+		return nil
+	}
+
+	payload := bytes.Join(bd.queue, nil)
+	if *debug {
+		for _, line := range bytes.Split(payload, []byte("\n")) {
+			if len(line) == 0 {
+				continue
+			}
+			log.Printf("DEBUG: %s", line)
+		}
+	}
+
+	err := withRetry(deadline, bd.retryPolicy, func() error {
+		return bd.send(payload, deadline)
+	})
+	if err != nil {
+		errmsg := fmt.Sprintf("failed to write stats to %s - %s", bd.addr, err)
+		return errors.New(errmsg)
+	}
+
+	log.Printf("sent %d stats to %s", num, bd.addr)
+	bd.queue = nil
+
+	return nil
+}
+
+// enqueue appends buf to the pending queue, dropping the oldest batch once
+// maxQueue is exceeded so a persistently slow upstream can't grow memory
+// without bound.
+func (bd *influxDBBackend) enqueue(buf []byte) {
+	if len(buf) == 0 {
+		return
+	}
+	cp := make([]byte, len(buf))
+	copy(cp, buf)
+	bd.queue = append(bd.queue, cp)
+	if bd.maxQueue > 0 && len(bd.queue) > bd.maxQueue {
+		dropped := len(bd.queue) - bd.maxQueue
+		log.Printf("WARNING: influxdb queue full, dropping %d oldest batch(es)", dropped)
+		bd.queue = bd.queue[dropped:]
+	}
+}
+
+func (bd *influxDBBackend) send(payload []byte, deadline time.Time) error {
+	if err := maybeInjectFailure(); err != nil {
+		return err
+	}
+
+	body := payload
+	contentEncoding := ""
+	if bd.gzip {
+		var gz bytes.Buffer
+		w := gzip.NewWriter(&gz)
+		if _, err := w.Write(payload); err != nil {
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+		body = gz.Bytes()
+		contentEncoding = "gzip"
+	}
+
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", bd.writeURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if contentEncoding != "" {
+		req.Header.Set("Content-Encoding", contentEncoding)
+	}
+	if bd.version == influxDBV2 {
+		req.Header.Set("Authorization", fmt.Sprintf("Token %s", bd.token))
+	}
+
+	resp, err := bd.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("influxdb returned status %s", resp.Status)
+	}
+	return nil
+}
+
+// scaleToPrecision rescales a unix-seconds timestamp, as carried on every
+// Snapshot, to the precision InfluxDB was configured to accept.
+func scaleToPrecision(unixSeconds int64, precision string) int64 {
+	switch precision {
+	case "ms":
+		return unixSeconds * 1e3
+	case "ns":
+		return unixSeconds * 1e9
+	default:
+		return unixSeconds
+	}
+}
+
+func (bd *influxDBBackend) writeLine(buffer *bytes.Buffer, metric string, fields string, now int64) {
+	name, tags := bd.parseMetric(metric)
+	if tags == "" {
+		fmt.Fprintf(buffer, "%s %s %d\n", name, fields, now)
+		return
+	}
+	fmt.Fprintf(buffer, "%s,%s %s %d\n", name, tags, fields, now)
+}
+
+func (bd *influxDBBackend) processCounters(buffer *bytes.Buffer, snap *Snapshot, now int64) int64 {
+	var num int64
+	for bucket, value := range snap.Counters {
+		bd.writeLine(buffer, bucket, fmt.Sprintf("value=%s", strconv.FormatFloat(value, 'f', -1, 64)), now)
+		num++
+	}
+	for _, bucket := range snap.ZeroFilledCounters {
+		bd.writeLine(buffer, bucket, "value=0", now)
+		num++
+	}
+	return num
+}
+
+func (bd *influxDBBackend) processGauges(buffer *bytes.Buffer, snap *Snapshot, now int64) int64 {
+	var num int64
+	for bucket, currentValue := range snap.Gauges {
+		bd.writeLine(buffer, bucket, fmt.Sprintf("value=%s", strconv.FormatFloat(currentValue, 'f', -1, 64)), now)
+		num++
+	}
+	return num
+}
+
+func (bd *influxDBBackend) processSets(buffer *bytes.Buffer, snap *Snapshot, now int64) int64 {
+	num := int64(len(snap.Sets))
+	for bucket, set := range snap.Sets {
+		uniqueSet := map[string]bool{}
+		for _, str := range set {
+			uniqueSet[str] = true
+		}
+		bd.writeLine(buffer, bucket, fmt.Sprintf("value=%d", len(uniqueSet)), now)
+	}
+	return num
+}
+
+// processTimers emits a single point per timer bucket carrying count, mean,
+// min, max and one field per configured percentile, rather than one line per
+// aggregate as the graphite backend does. Each bucket's aggregates come out
+// of snap.TimerStats, which takeSnapshot computed once per flush rather than
+// once per backend.
+func (bd *influxDBBackend) processTimers(buffer *bytes.Buffer, snap *Snapshot, now int64, pctls Percentiles) int64 {
+	var num int64
+	for bucket := range snap.Timers {
+		// Re-attach the tags (via the same canonical marker writeLine's
+		// parseMetric expects) to the derived name.
+		bucketWithoutPostfix, tags := splitTimerBucket(bucket)
+		tagKeySuffix := ""
+		if len(tags) > 0 {
+			tagKeySuffix = canonicalKeySep + canonicalTagString(tags)
+		}
+		num++
+
+		stats := snap.TimerStats[bucket]
+
+		fields := []string{
+			fmt.Sprintf("count=%di", stats.Count),
+			fmt.Sprintf("mean=%s", strconv.FormatFloat(stats.Mean, 'f', -1, 64)),
+			fmt.Sprintf("min=%s", strconv.FormatFloat(stats.Min, 'f', -1, 64)),
+			fmt.Sprintf("max=%s", strconv.FormatFloat(stats.Max, 'f', -1, 64)),
+		}
+
+		for i, pct := range pctls {
+			var fieldName string
+			if pct.float >= 0 {
+				fieldName = fmt.Sprintf("upper_%s", pct.str)
+			} else {
+				fieldName = fmt.Sprintf("lower_%s", pct.str[1:])
+			}
+			fields = append(fields, fmt.Sprintf("%s=%s", fieldName, strconv.FormatFloat(stats.Percentiles[i], 'f', -1, 64)))
+		}
+
+		bd.writeLine(buffer, bucketWithoutPostfix+*postfix+tagKeySuffix, strings.Join(fields, ","), now)
+	}
+	return num
+}
+
+// parseMetric splits a bucket key into the InfluxDB measurement and its tag
+// set rendered as line-protocol "k1=v1,k2=v2", accepting the same set of
+// wire conventions as openFalconBackend.parseMetric.
+func (bd *influxDBBackend) parseMetric(metric string) (string, string) {
+	name, tags := splitCanonicalKey(metric)
+	return name, canonicalTagString(tags)
+}
@@ -6,10 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"log"
-	"math"
 	"net/http"
-	"sort"
-	"strings"
 	"time"
 )
 
@@ -28,15 +25,23 @@ type openFalconMsg struct {
 }
 
 type openFalconBackend struct {
-	addr    string
-	postUrl string
-	packets []*openFalconMsg
+	addr        string
+	postUrl     string
+	packets     []*openFalconMsg
+	retryPolicy retryPolicy
+
+	// spool holds packets that still failed after retries exhausted, so the
+	// next successful flush can carry them along instead of losing them.
+	spool    []*openFalconMsg
+	maxSpool int
 }
 
 func NewOpenFalconBackend(addr string) backend {
 	return &openFalconBackend{
-		addr:    addr,
-		postUrl: fmt.Sprintf("http://%s/v1/push", addr),
+		addr:        addr,
+		postUrl:     fmt.Sprintf("http://%s/v1/push", addr),
+		retryPolicy: defaultRetryPolicy,
+		maxSpool:    1000,
 	}
 }
 
@@ -54,26 +59,28 @@ func (bd *openFalconBackend) appendPacket(metric string, value float64, now int6
 	bd.packets = append(bd.packets, msg)
 }
 
-func (bd *openFalconBackend) submit(deadline time.Time) error {
-	var num int
-
-	now := time.Now().Unix()
-
+func (bd *openFalconBackend) submit(snap *Snapshot, deadline time.Time) error {
 	defer func() {
 		bd.packets = nil
 	}()
 
-	bd.processCounters(now)
-	bd.processGauges(now)
-	bd.processTimers(now, percentThreshold)
-	bd.processSets(now)
-	num = len(bd.packets)
+	bd.processCounters(snap)
+	bd.processGauges(snap)
+	bd.processTimers(snap, percentThreshold)
+	bd.processSets(snap)
 
+	bd.spool = append(bd.spool, bd.packets...)
+	if len(bd.spool) > bd.maxSpool {
+		dropped := len(bd.spool) - bd.maxSpool
+		log.Printf("WARNING: openfalcon spool full, dropping %d oldest packet(s)", dropped)
+		bd.spool = bd.spool[dropped:]
+	}
+	num := len(bd.spool)
 	if num == 0 {
 		return nil
 	}
 
-	buffer, err := json.Marshal(bd.packets)
+	buffer, err := json.Marshal(bd.spool)
 	if err != nil {
 		errmsg := fmt.Sprintf("failed to marshal json - %s", err)
 		return errors.New(errmsg)
@@ -81,126 +88,111 @@ func (bd *openFalconBackend) submit(deadline time.Time) error {
 	if *debug {
 		log.Printf("DEBUG: %v", string(buffer))
 	}
-	req, err := http.NewRequest("POST", bd.postUrl, bytes.NewBuffer(buffer))
-	req.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	err = withRetry(deadline, bd.retryPolicy, func() error {
+		return bd.post(buffer)
+	})
 	if err != nil {
-		errmsg := fmt.Sprintf("failed to write stats - %s", err)
+		errmsg := fmt.Sprintf("failed to write stats to %s - %s", bd.addr, err)
 		return errors.New(errmsg)
 	}
-	defer resp.Body.Close()
 
 	log.Printf("sent %d stats to %s", num, bd.addr)
+	bd.spool = nil
 
 	return nil
 }
 
-func (bd *openFalconBackend) processCounters(now int64) {
-	// continue sending zeros for counters for a short period of time even if we have no new data
-	for bucket, value := range counters {
-		bd.appendPacket(bucket, value, now)
+func (bd *openFalconBackend) post(buffer []byte) error {
+	if err := maybeInjectFailure(); err != nil {
+		return err
+	}
 
-		delete(counters, bucket)
-		countInactivity[bucket] = 0
+	req, err := http.NewRequest("POST", bd.postUrl, bytes.NewBuffer(buffer))
+	if err != nil {
+		return err
 	}
-	for bucket, purgeCount := range countInactivity {
-		if purgeCount > 0 {
-			bd.appendPacket(bucket, 0, now)
-		}
-		countInactivity[bucket]++
-		if countInactivity[bucket] > *persistCountKeys {
-			delete(countInactivity, bucket)
-		}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to write stats - %s", err)
 	}
+	defer resp.Body.Close()
+
+	return nil
 }
 
-func (bd *openFalconBackend) processGauges(now int64) {
-	for bucket, currentValue := range gauges {
-		bd.appendPacket(bucket, currentValue, now)
+func (bd *openFalconBackend) processCounters(snap *Snapshot) {
+	for bucket, value := range snap.Counters {
+		bd.appendPacket(bucket, value, snap.Now)
+	}
+	// continue sending zeros for counters for a short period of time even if we have no new data
+	for _, bucket := range snap.ZeroFilledCounters {
+		bd.appendPacket(bucket, 0, snap.Now)
+	}
+}
 
-		if *deleteGauges {
-			delete(gauges, bucket)
-		}
+func (bd *openFalconBackend) processGauges(snap *Snapshot) {
+	for bucket, currentValue := range snap.Gauges {
+		bd.appendPacket(bucket, currentValue, snap.Now)
 	}
 }
 
-func (bd *openFalconBackend) processSets(now int64) {
-	for bucket, set := range sets {
+func (bd *openFalconBackend) processSets(snap *Snapshot) {
+	for bucket, set := range snap.Sets {
 
 		uniqueSet := map[string]bool{}
 		for _, str := range set {
 			uniqueSet[str] = true
 		}
 
-		bd.appendPacket(bucket, float64(len(uniqueSet)), now)
-
-		delete(sets, bucket)
+		bd.appendPacket(bucket, float64(len(uniqueSet)), snap.Now)
 	}
 }
 
-func (bd *openFalconBackend) processTimers(now int64, pctls Percentiles) {
-	for bucket, timer := range timers {
-		bucketWithoutPostfix := bucket[:len(bucket)-len(*postfix)]
-
-		sort.Sort(timer)
-		min := timer[0]
-		max := timer[len(timer)-1]
-		maxAtThreshold := max
-		count := len(timer)
-
-		sum := float64(0)
-		for _, value := range timer {
-			sum += value
+// processTimers reads each bucket's aggregates out of snap.TimerStats, which
+// takeSnapshot computed once per flush, rather than recomputing them here -
+// with more than one backend registered, recomputing per backend would redo
+// the same sort-or-digest work per bucket once per backend instead of once
+// per flush.
+func (bd *openFalconBackend) processTimers(snap *Snapshot, pctls Percentiles) {
+	for bucket := range snap.Timers {
+		// Re-attach the tags (via the same canonical marker appendPacket's
+		// parseMetric expects) to each derived name.
+		bucketWithoutPostfix, tags := splitTimerBucket(bucket)
+		tagKeySuffix := ""
+		if len(tags) > 0 {
+			tagKeySuffix = canonicalKeySep + canonicalTagString(tags)
 		}
-		mean := sum / float64(len(timer))
-
-		for _, pct := range pctls {
-			if len(timer) > 1 {
-				var abs float64
-				if pct.float >= 0 {
-					abs = pct.float
-				} else {
-					abs = 100 + pct.float
-				}
-				// poor man's math.Round(x):
-				// math.Floor(x + 0.5)
-				indexOfPerc := int(math.Floor(((abs / 100.0) * float64(count)) + 0.5))
-				if pct.float >= 0 {
-					indexOfPerc-- // index offset=0
-				}
-				maxAtThreshold = timer[indexOfPerc]
-			}
 
+		stats := snap.TimerStats[bucket]
+
+		for i, pct := range pctls {
 			var metric string
 			var pctstr string
 			if pct.float >= 0 {
 				pctstr = pct.str
-				metric = fmt.Sprintf("%s.upper_%s%s", bucketWithoutPostfix, pctstr, *postfix)
+				metric = fmt.Sprintf("%s.upper_%s%s%s", bucketWithoutPostfix, pctstr, *postfix, tagKeySuffix)
 			} else {
 				pctstr = pct.str[1:]
-				metric = fmt.Sprintf("%s.lower_%s%s", bucketWithoutPostfix, pctstr, *postfix)
+				metric = fmt.Sprintf("%s.lower_%s%s%s", bucketWithoutPostfix, pctstr, *postfix, tagKeySuffix)
 			}
-			bd.appendPacket(metric, maxAtThreshold, now)
+			bd.appendPacket(metric, stats.Percentiles[i], snap.Now)
 		}
 
-		bd.appendPacket(fmt.Sprintf("%s.mean%s", bucketWithoutPostfix, *postfix), mean, now)
-		bd.appendPacket(fmt.Sprintf("%s.upper%s", bucketWithoutPostfix, *postfix), max, now)
-		bd.appendPacket(fmt.Sprintf("%s.lower%s", bucketWithoutPostfix, *postfix), min, now)
-		bd.appendPacket(fmt.Sprintf("%s.count%s", bucketWithoutPostfix, *postfix), float64(count), now)
-
-		delete(timers, bucket)
+		bd.appendPacket(fmt.Sprintf("%s.mean%s%s", bucketWithoutPostfix, *postfix, tagKeySuffix), stats.Mean, snap.Now)
+		bd.appendPacket(fmt.Sprintf("%s.upper%s%s", bucketWithoutPostfix, *postfix, tagKeySuffix), stats.Max, snap.Now)
+		bd.appendPacket(fmt.Sprintf("%s.lower%s%s", bucketWithoutPostfix, *postfix, tagKeySuffix), stats.Min, snap.Now)
+		bd.appendPacket(fmt.Sprintf("%s.count%s%s", bucketWithoutPostfix, *postfix, tagKeySuffix), float64(stats.Count), snap.Now)
 	}
 }
 
+// parseMetric splits a bucket key - a canonical key as produced by
+// canonicalMetricKey, or a legacy `/`-suffixed key - into its bare metric
+// name and its tags rendered as OpenFalcon's native "k1=v1,k2=v2" string.
 func (bd *openFalconBackend) parseMetric(metric string) (string, string) {
-	name := metric
-	tags := ""
-	index := strings.LastIndex(metric, "/")
-	if index >= 0 {
-		name = metric[:index]
-		tags = metric[index+1:]
-	}
-	return name, tags
+	name, tags := splitCanonicalKey(metric)
+	return name, canonicalTagString(tags)
 }
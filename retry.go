@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+)
+
+// retryPolicy controls how a backend retries a failed submit within a single
+// flush cycle: exponential backoff with jitter, bounded by both a maximum
+// attempt count and the flush deadline.
+type retryPolicy struct {
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	MaxAttempts int
+}
+
+// defaultRetryPolicy is used by backends that aren't given an explicit
+// policy, matching the modest retry budget of a single flush interval.
+var defaultRetryPolicy = retryPolicy{
+	BaseDelay:   100 * time.Millisecond,
+	MaxDelay:    5 * time.Second,
+	MaxAttempts: 5,
+}
+
+var errDeadlineExceeded = errors.New("retry: deadline exceeded before attempt")
+
+// withRetry calls fn until it succeeds, the policy's attempt budget is
+// exhausted, or deadline passes, whichever comes first. Backoff between
+// attempts grows exponentially from BaseDelay up to MaxDelay, and each sleep
+// is jittered to a random value between 50% and 100% of that delay to avoid
+// synchronized retries across backends.
+func withRetry(deadline time.Time, policy retryPolicy, fn func() error) error {
+	var lastErr error
+	delay := policy.BaseDelay
+
+	for attempt := 1; policy.MaxAttempts <= 0 || attempt <= policy.MaxAttempts; attempt++ {
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			if lastErr != nil {
+				return lastErr
+			}
+			return errDeadlineExceeded
+		}
+
+		lastErr = fn()
+		if lastErr == nil {
+			return nil
+		}
+
+		if attempt == policy.MaxAttempts {
+			break
+		}
+
+		sleep := delay
+		if sleep > policy.MaxDelay {
+			sleep = policy.MaxDelay
+		}
+		sleep = sleep/2 + time.Duration(rand.Int63n(int64(sleep/2)+1))
+
+		if !deadline.IsZero() {
+			if remaining := time.Until(deadline); remaining < sleep {
+				sleep = remaining
+			}
+			if sleep <= 0 {
+				return lastErr
+			}
+		}
+
+		time.Sleep(sleep)
+		delay *= 2
+	}
+
+	return lastErr
+}
+
+// maybeInjectFailure randomly returns an error at *simulateFailureRate
+// probability so operators can exercise the retry/spool path against an
+// otherwise healthy upstream. It is a no-op when the flag is unset or zero.
+func maybeInjectFailure() error {
+	if simulateFailureRate == nil || *simulateFailureRate <= 0 {
+		return nil
+	}
+	if rand.Float64() < *simulateFailureRate {
+		return errors.New("simulated failure (--simulate-failure-rate)")
+	}
+	return nil
+}
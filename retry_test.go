@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestWithRetry_SucceedsOnFirstAttempt(t *testing.T) {
+	calls := 0
+	policy := retryPolicy{BaseDelay: time.Millisecond, MaxDelay: time.Millisecond, MaxAttempts: 5}
+
+	err := withRetry(time.Now().Add(time.Second), policy, func() error {
+		calls++
+		return nil
+	})
+
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if calls != 1 {
+		t.Fatalf("expected 1 call, got %d", calls)
+	}
+}
+
+func TestWithRetry_StopsAtMaxAttempts(t *testing.T) {
+	calls := 0
+	policy := retryPolicy{BaseDelay: time.Millisecond, MaxDelay: time.Millisecond, MaxAttempts: 3}
+	wantErr := errors.New("always fails")
+
+	err := withRetry(time.Now().Add(time.Second), policy, func() error {
+		calls++
+		return wantErr
+	})
+
+	if err != wantErr {
+		t.Fatalf("expected %v, got %v", wantErr, err)
+	}
+	if calls != policy.MaxAttempts {
+		t.Fatalf("expected %d calls, got %d", policy.MaxAttempts, calls)
+	}
+}
+
+func TestWithRetry_DeadlineAlreadyPassedNeverCallsFn(t *testing.T) {
+	calls := 0
+	policy := retryPolicy{BaseDelay: time.Millisecond, MaxDelay: time.Millisecond, MaxAttempts: 5}
+
+	err := withRetry(time.Now().Add(-time.Second), policy, func() error {
+		calls++
+		return nil
+	})
+
+	if err != errDeadlineExceeded {
+		t.Fatalf("expected errDeadlineExceeded, got %v", err)
+	}
+	if calls != 0 {
+		t.Fatalf("expected fn never called, got %d calls", calls)
+	}
+}
+
+func TestWithRetry_DeadlineCutsAttemptsShort(t *testing.T) {
+	calls := 0
+	policy := retryPolicy{BaseDelay: 50 * time.Millisecond, MaxDelay: time.Second, MaxAttempts: 100}
+	wantErr := errors.New("always fails")
+
+	deadline := time.Now().Add(120 * time.Millisecond)
+	start := time.Now()
+	err := withRetry(deadline, policy, func() error {
+		calls++
+		return wantErr
+	})
+	elapsed := time.Since(start)
+
+	if err != wantErr {
+		t.Fatalf("expected %v, got %v", wantErr, err)
+	}
+	if calls >= policy.MaxAttempts {
+		t.Fatalf("expected deadline to cut attempts well short of MaxAttempts, got %d calls", calls)
+	}
+	if elapsed > time.Second {
+		t.Fatalf("withRetry ran well past its deadline: %s", elapsed)
+	}
+}
+
+func TestWithRetry_ZeroDeadlineMeansNoDeadline(t *testing.T) {
+	calls := 0
+	policy := retryPolicy{BaseDelay: time.Millisecond, MaxDelay: time.Millisecond, MaxAttempts: 2}
+	wantErr := errors.New("always fails")
+
+	err := withRetry(time.Time{}, policy, func() error {
+		calls++
+		return wantErr
+	})
+
+	if err != wantErr {
+		t.Fatalf("expected %v, got %v", wantErr, err)
+	}
+	if calls != policy.MaxAttempts {
+		t.Fatalf("expected %d calls, got %d", policy.MaxAttempts, calls)
+	}
+}
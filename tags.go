@@ -0,0 +1,189 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// tagCardinalitySeen tracks, per bare metric name, the distinct canonical tag
+// strings already admitted, so enforceTagCardinality can bound how many
+// distinct series a single metric name may create.
+var tagCardinalitySeen = map[string]map[string]bool{}
+
+// droppedHighCardinalitySeries counts packets rejected by
+// enforceTagCardinality. takeSnapshot folds it into the regular counters map
+// as a self metric so it shows up on the same dashboards as everything else.
+var droppedHighCardinalitySeries int64
+
+// parseMetricTags splits a raw wire-packet bucket key into its bare metric
+// name and tag set, accepting any of three conventions:
+//
+//	name/tag1=val1,tag2=val2    the original OpenFalcon-style suffix
+//	name|#tag1:val1,tag2:val2   DogStatsD inline tags
+//	name,tag1=val1,tag2=val2    InfluxDB-style tags in the metric name
+//
+// NOTE: this repo's UDP/TCP listener is not part of this tree, so nothing
+// here calls parseMetricTags yet - the live counters/gauges/timers/sets maps
+// are still keyed by whatever the (absent) ingest path already produces.
+// This function, canonicalMetricKey and enforceTagCardinality exist so that
+// wiring tag-aware ingest in is a matter of calling them from the packet
+// parser; until that parser is wired up, tag-aware aggregation keys and
+// cardinality limiting do not take effect.
+func parseMetricTags(metric string) (string, map[string]string) {
+	if idx := strings.Index(metric, "|#"); idx >= 0 {
+		return metric[:idx], splitTagPairs(metric[idx+2:], ':')
+	}
+	comma := strings.Index(metric, ",")
+	slash := strings.LastIndex(metric, "/")
+	if comma >= 0 && (slash < 0 || comma < slash) {
+		return metric[:comma], splitTagPairs(metric[comma+1:], '=')
+	}
+	if slash >= 0 {
+		return metric[:slash], splitTagPairs(metric[slash+1:], '=')
+	}
+	return metric, nil
+}
+
+// canonicalKeySep joins a bare metric name and its canonical tag string in
+// canonicalMetricKey. It's a non-printable separator precisely so it can
+// never collide with the `/`, `,` or `=` that the wire conventions above (or
+// canonicalTagString's own output) can contain - splitCanonicalKey relies on
+// that to unambiguously undo canonicalMetricKey.
+const canonicalKeySep = "\x1f"
+
+// splitCanonicalKey reverses canonicalMetricKey: it splits a key out of the
+// counters/gauges/timers/sets maps back into its bare metric name and tag
+// set. It is deliberately distinct from parseMetricTags - the wire-packet
+// parser knows nothing of canonicalKeySep and splits on a bare comma or `/`
+// instead, so re-running it against our own canonical key would misparse any
+// tagged metric: a single tag would stay part of the name, and with 2+ tags
+// the split would land on a comma inside canonicalTagString's output.
+func splitCanonicalKey(key string) (string, map[string]string) {
+	if idx := strings.Index(key, canonicalKeySep); idx >= 0 {
+		return key[:idx], splitTagPairs(key[idx+len(canonicalKeySep):], '=')
+	}
+	// Fall back to the legacy `/`-suffix convention for any bucket key that
+	// was never round-tripped through canonicalMetricKey.
+	if idx := strings.LastIndex(key, "/"); idx >= 0 {
+		return key[:idx], splitTagPairs(key[idx+1:], '=')
+	}
+	return key, nil
+}
+
+// splitTimerBucket splits a timer's canonical key into its postfix-stripped
+// bare metric name and tag set, for the three backends' processTimers to
+// render however each one renders tags. Tags must come off before the
+// postfix is stripped: *postfix is the tail of the bare name, not of
+// whatever tag value happens to be last in the key.
+func splitTimerBucket(bucket string) (string, map[string]string) {
+	name, tags := splitCanonicalKey(bucket)
+	return name[:len(name)-len(*postfix)], tags
+}
+
+func splitTagPairs(raw string, sep byte) map[string]string {
+	if raw == "" {
+		return nil
+	}
+	tags := map[string]string{}
+	for _, pair := range strings.Split(raw, ",") {
+		idx := strings.IndexByte(pair, sep)
+		if idx < 0 {
+			continue
+		}
+		tags[pair[:idx]] = pair[idx+1:]
+	}
+	return tags
+}
+
+// sortedTagKeys returns tags' keys in sorted order, so every caller that
+// needs to walk a tag set in a stable, canonical order shares one
+// implementation.
+func sortedTagKeys(tags map[string]string) []string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// canonicalTagString renders tags in sorted "k1=v1,k2=v2" form, OpenFalcon's
+// native tag syntax, so the same tag set always produces the same
+// aggregation key and the same wire representation regardless of which
+// input convention it arrived in.
+func canonicalTagString(tags map[string]string) string {
+	if len(tags) == 0 {
+		return ""
+	}
+	keys := sortedTagKeys(tags)
+	var b strings.Builder
+	for i, k := range keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(tags[k])
+	}
+	return b.String()
+}
+
+// graphiteTagSuffix renders tags using Graphite 1.1+ tag syntax
+// (";tag1=val1;tag2=val2"), ready to append directly after a metric name.
+func graphiteTagSuffix(tags map[string]string) string {
+	if len(tags) == 0 {
+		return ""
+	}
+	keys := sortedTagKeys(tags)
+	var b strings.Builder
+	for _, k := range keys {
+		b.WriteByte(';')
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(tags[k])
+	}
+	return b.String()
+}
+
+// canonicalMetricKey combines a bare metric name and its canonical tag
+// string back into the single string meant to be used as the key into the
+// counters, gauges, timers and sets maps, so two packets for the same name
+// and tag set would aggregate together however their tags were encoded on
+// the wire. See splitCanonicalKey for the inverse. Not yet called from an
+// ingest path in this tree - see the note on parseMetricTags.
+func canonicalMetricKey(name, tags string) string {
+	if tags == "" {
+		return name
+	}
+	return name + canonicalKeySep + tags
+}
+
+// enforceTagCardinality reports whether a new tag combination for name
+// should be admitted into the aggregation maps. Once a name has accumulated
+// maxTagCardinality distinct tag sets, further new combinations are rejected
+// and counted in droppedHighCardinalitySeries rather than growing the series
+// count without bound. Not yet called from an ingest path in this tree - see
+// the note on parseMetricTags. Until it is wired in, droppedHighCardinalitySeries
+// (and the statsd.dropped_high_cardinality_series metric takeSnapshot derives
+// from it) will always read zero.
+func enforceTagCardinality(name, tagString string) bool {
+	limit := 1000
+	if maxTagCardinality != nil && *maxTagCardinality > 0 {
+		limit = *maxTagCardinality
+	}
+
+	seen, ok := tagCardinalitySeen[name]
+	if !ok {
+		seen = map[string]bool{}
+		tagCardinalitySeen[name] = seen
+	}
+	if seen[tagString] {
+		return true
+	}
+	if len(seen) >= limit {
+		droppedHighCardinalitySeries++
+		return false
+	}
+	seen[tagString] = true
+	return true
+}